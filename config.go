@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// config is the structure of the configuration for the Packer CLI.
+//
+// This is not the configuration for templates. Packer templates are
+// parsed in the "template" package.
+type config struct {
+	PluginMinPort int
+	PluginMaxPort int
+
+	DisableCheckpoint          bool `json:"disable_checkpoint"`
+	DisableCheckpointSignature bool `json:"disable_checkpoint_signature"`
+
+	// Clean, when true, makes LoadExternalComponentsFromConfig remove any
+	// previously-registered external builder, provisioner, or
+	// post-processor whose backing binary no longer exists or whose
+	// checksum no longer matches, before loading the entries below.
+	Clean bool `json:"clean"`
+
+	RawBuilders       map[string]json.RawMessage `json:"builders"`
+	RawPostProcessors map[string]json.RawMessage `json:"post-processors"`
+	RawProvisioners   map[string]json.RawMessage `json:"provisioners"`
+
+	// PluginDirs is a list of directories that are scanned for
+	// packer-builder-*, packer-provisioner-*, and packer-post-processor-*
+	// binaries, as an alternative to listing each one under
+	// RawBuilders/RawProvisioners/RawPostProcessors. An explicit entry for
+	// a given name always takes precedence over one discovered this way.
+	PluginDirs []string `json:"plugin_dirs"`
+
+	Builders       packer.MapOfBuilder
+	PostProcessors packer.MapOfPostProcessor
+	Provisioners   packer.MapOfProvisioner
+
+	resolvedBuilders       map[string]resolvedPlugin
+	resolvedProvisioners   map[string]resolvedPlugin
+	resolvedPostProcessors map[string]resolvedPlugin
+}
+
+// PluginConfig describes a single entry under the "builders",
+// "provisioners", or "post-processors" maps of a packerconfig file. It may
+// be written as a bare string giving the path to the plugin binary, or as
+// an object for cases where the plugin needs extra CLI args or
+// environment variables, must be pinned to a known-good checksum, or must
+// satisfy a version constraint.
+type PluginConfig struct {
+	Path       string   `json:"path"`
+	Args       []string `json:"args"`
+	Env        []string `json:"env"`
+	Checksum   string   `json:"checksum"`
+	MinVersion string   `json:"min_version"`
+	MaxVersion string   `json:"max_version"`
+
+	// Clean, when true, makes LoadExternalComponentsFromConfig check this
+	// single entry's binary (and checksum, if set) while loading, and drop
+	// the entry from the registered components if the binary is missing or
+	// no longer matches, rather than registering it and leaving that
+	// failure to surface on first use.
+	Clean bool `json:"clean"`
+}
+
+// UnmarshalJSON allows a PluginConfig to be specified either as a bare
+// string (the path to the plugin binary) or as the full object form.
+func (p *PluginConfig) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		p.Path = path
+		return nil
+	}
+
+	// Alias PluginConfig so the object-form decode below doesn't recurse
+	// back into this UnmarshalJSON method.
+	type plainPluginConfig PluginConfig
+	var plain plainPluginConfig
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+
+	*p = PluginConfig(plain)
+	return nil
+}
+
+// resolvedPlugin records the on-disk location and expected checksum that
+// an external plugin entry was last resolved to, so that
+// CleanExternalComponents can later detect entries that have gone stale.
+type resolvedPlugin struct {
+	path     string
+	checksum string
+}
+
+// decodeConfig decodes JSON from r into c.
+func decodeConfig(r io.Reader, c *config) error {
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// decodePluginConfig unmarshals a single raw builders/provisioners/
+// post-processors entry into a PluginConfig, accepting either the bare
+// string form or the full object form.
+func decodePluginConfig(raw json.RawMessage) (PluginConfig, error) {
+	var pc PluginConfig
+	if err := json.Unmarshal(raw, &pc); err != nil {
+		return PluginConfig{}, err
+	}
+
+	return pc, nil
+}
+
+// LoadExternalComponentsFromConfig loads the plugins configured in the
+// "builders", "provisioners", and "post-processors" maps of c and
+// registers them with the corresponding Map so that they're available to
+// the rest of Packer.
+func (c *config) LoadExternalComponentsFromConfig() {
+	if c.Clean {
+		if err := c.CleanExternalComponents(); err != nil {
+			log.Printf("[ERR] failed to clean stale external plugins: %s", err)
+		}
+	}
+
+	if c.Builders != nil {
+		if c.resolvedBuilders == nil {
+			c.resolvedBuilders = make(map[string]resolvedPlugin)
+		}
+		for name, raw := range c.RawBuilders {
+			name, raw := name, raw
+
+			pc, err := decodePluginConfig(raw)
+			if err != nil {
+				log.Printf("[ERR] failed to decode builder plugin %q: %s", name, err)
+				continue
+			}
+
+			if pc.Clean || c.Clean {
+				// Force re-resolution now, rather than trusting whatever
+				// was previously registered under name: validate the
+				// binary eagerly and drop the entry entirely if it's
+				// missing or its checksum no longer matches, instead of
+				// waiting for that failure to surface lazily on first use.
+				stale, err := pluginIsStale(resolvedPlugin{path: pc.Path, checksum: pc.Checksum})
+				if err != nil {
+					log.Printf("[ERR] failed to validate builder plugin %q: %s", name, err)
+					continue
+				}
+				if stale {
+					log.Printf("[ERR] skipping builder plugin %q: %q is missing or its checksum no longer matches", name, pc.Path)
+					c.Builders.Delete(name)
+					delete(c.resolvedBuilders, name)
+					continue
+				}
+			}
+
+			c.resolvedBuilders[name] = resolvedPlugin{path: pc.Path, checksum: pc.Checksum}
+			c.Builders.Set(name, func() (packer.Builder, error) {
+				client, err := c.pluginClient(pc)
+				if err != nil {
+					return nil, err
+				}
+				b, err := client.Builder()
+				if err != nil {
+					return nil, err
+				}
+				if err := enforcePluginVersion(b, pc); err != nil {
+					client.Kill()
+					return nil, err
+				}
+				return b, nil
+			})
+		}
+	}
+
+	if c.Provisioners != nil {
+		if c.resolvedProvisioners == nil {
+			c.resolvedProvisioners = make(map[string]resolvedPlugin)
+		}
+		for name, raw := range c.RawProvisioners {
+			name, raw := name, raw
+
+			pc, err := decodePluginConfig(raw)
+			if err != nil {
+				log.Printf("[ERR] failed to decode provisioner plugin %q: %s", name, err)
+				continue
+			}
+
+			if pc.Clean || c.Clean {
+				// Force re-resolution now, rather than trusting whatever
+				// was previously registered under name: validate the
+				// binary eagerly and drop the entry entirely if it's
+				// missing or its checksum no longer matches, instead of
+				// waiting for that failure to surface lazily on first use.
+				stale, err := pluginIsStale(resolvedPlugin{path: pc.Path, checksum: pc.Checksum})
+				if err != nil {
+					log.Printf("[ERR] failed to validate provisioner plugin %q: %s", name, err)
+					continue
+				}
+				if stale {
+					log.Printf("[ERR] skipping provisioner plugin %q: %q is missing or its checksum no longer matches", name, pc.Path)
+					c.Provisioners.Delete(name)
+					delete(c.resolvedProvisioners, name)
+					continue
+				}
+			}
+
+			c.resolvedProvisioners[name] = resolvedPlugin{path: pc.Path, checksum: pc.Checksum}
+			c.Provisioners.Set(name, func() (packer.Provisioner, error) {
+				client, err := c.pluginClient(pc)
+				if err != nil {
+					return nil, err
+				}
+				p, err := client.Provisioner()
+				if err != nil {
+					return nil, err
+				}
+				if err := enforcePluginVersion(p, pc); err != nil {
+					client.Kill()
+					return nil, err
+				}
+				return p, nil
+			})
+		}
+	}
+
+	if c.PostProcessors != nil {
+		if c.resolvedPostProcessors == nil {
+			c.resolvedPostProcessors = make(map[string]resolvedPlugin)
+		}
+		for name, raw := range c.RawPostProcessors {
+			name, raw := name, raw
+
+			pc, err := decodePluginConfig(raw)
+			if err != nil {
+				log.Printf("[ERR] failed to decode post-processor plugin %q: %s", name, err)
+				continue
+			}
+
+			if pc.Clean || c.Clean {
+				// Force re-resolution now, rather than trusting whatever
+				// was previously registered under name: validate the
+				// binary eagerly and drop the entry entirely if it's
+				// missing or its checksum no longer matches, instead of
+				// waiting for that failure to surface lazily on first use.
+				stale, err := pluginIsStale(resolvedPlugin{path: pc.Path, checksum: pc.Checksum})
+				if err != nil {
+					log.Printf("[ERR] failed to validate post-processor plugin %q: %s", name, err)
+					continue
+				}
+				if stale {
+					log.Printf("[ERR] skipping post-processor plugin %q: %q is missing or its checksum no longer matches", name, pc.Path)
+					c.PostProcessors.Delete(name)
+					delete(c.resolvedPostProcessors, name)
+					continue
+				}
+			}
+
+			c.resolvedPostProcessors[name] = resolvedPlugin{path: pc.Path, checksum: pc.Checksum}
+			c.PostProcessors.Set(name, func() (packer.PostProcessor, error) {
+				client, err := c.pluginClient(pc)
+				if err != nil {
+					return nil, err
+				}
+				pp, err := client.PostProcessor()
+				if err != nil {
+					return nil, err
+				}
+				if err := enforcePluginVersion(pp, pc); err != nil {
+					client.Kill()
+					return nil, err
+				}
+				return pp, nil
+			})
+		}
+	}
+
+	c.loadPluginDirs()
+}
+
+// CleanExternalComponents removes previously-registered external builder,
+// provisioner, and post-processor entries whose backing binary no longer
+// exists on disk or whose checksum no longer matches, leaving live
+// plugins untouched. It can be called on its own, independently of
+// LoadExternalComponentsFromConfig, for example from a future
+// `packer plugins clean` subcommand.
+func (c *config) CleanExternalComponents() error {
+	if c.Builders != nil {
+		for name, rp := range c.resolvedBuilders {
+			stale, err := pluginIsStale(rp)
+			if err != nil {
+				return err
+			}
+			if stale {
+				c.Builders.Delete(name)
+				delete(c.resolvedBuilders, name)
+			}
+		}
+	}
+
+	if c.Provisioners != nil {
+		for name, rp := range c.resolvedProvisioners {
+			stale, err := pluginIsStale(rp)
+			if err != nil {
+				return err
+			}
+			if stale {
+				c.Provisioners.Delete(name)
+				delete(c.resolvedProvisioners, name)
+			}
+		}
+	}
+
+	if c.PostProcessors != nil {
+		for name, rp := range c.resolvedPostProcessors {
+			stale, err := pluginIsStale(rp)
+			if err != nil {
+				return err
+			}
+			if stale {
+				c.PostProcessors.Delete(name)
+				delete(c.resolvedPostProcessors, name)
+			}
+		}
+	}
+
+	return nil
+}
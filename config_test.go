@@ -107,6 +107,331 @@ func TestLoadExternalComponentsFromConfig_onlyProvisioner(t *testing.T) {
 	}
 }
 
+func TestPluginConfig_UnmarshalJSON_string(t *testing.T) {
+	var pc PluginConfig
+	if err := json.Unmarshal([]byte(`"packer-builder-cloud-xyz"`), &pc); err != nil {
+		t.Fatalf("error encountered decoding plugin config: %v", err)
+	}
+
+	if pc.Path != "packer-builder-cloud-xyz" {
+		t.Errorf("expected Path %q, got %q", "packer-builder-cloud-xyz", pc.Path)
+	}
+}
+
+func TestPluginConfig_UnmarshalJSON_object(t *testing.T) {
+	raw := `
+	{
+		"path": "packer-builder-cloud-xyz",
+		"args": ["-debug"],
+		"env": ["CLOUD_XYZ_TOKEN=abc123"],
+		"checksum": "deadbeef",
+		"min_version": "1.0.0",
+		"max_version": "2.0.0"
+	}`
+
+	var pc PluginConfig
+	if err := json.Unmarshal([]byte(raw), &pc); err != nil {
+		t.Fatalf("error encountered decoding plugin config: %v", err)
+	}
+
+	expected := PluginConfig{
+		Path:       "packer-builder-cloud-xyz",
+		Args:       []string{"-debug"},
+		Env:        []string{"CLOUD_XYZ_TOKEN=abc123"},
+		Checksum:   "deadbeef",
+		MinVersion: "1.0.0",
+		MaxVersion: "2.0.0",
+	}
+	if !reflect.DeepEqual(pc, expected) {
+		t.Errorf("failed to decode object-form plugin config; expected %+v got %+v", expected, pc)
+	}
+}
+
+func TestCheckPluginVersion(t *testing.T) {
+	cases := []struct {
+		reported, min, max string
+		wantErr            bool
+	}{
+		{"1.5.0", "1.0.0", "2.0.0", false},
+		{"0.9.0", "1.0.0", "2.0.0", true},
+		{"2.1.0", "1.0.0", "2.0.0", true},
+		{"1.0.0", "", "", false},
+	}
+
+	for _, tc := range cases {
+		err := checkPluginVersion(tc.reported, tc.min, tc.max)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("checkPluginVersion(%q, %q, %q): got err %v, wantErr %v", tc.reported, tc.min, tc.max, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadExternalComponentsFromConfig_perEntryClean(t *testing.T) {
+	missingPath := filepath.Join(os.TempDir(), "packer-builder-does-not-exist")
+
+	packerConfigData := fmt.Sprintf(`
+	{
+		"PluginMinPort": 10,
+		"PluginMaxPort": 25,
+		"builders": {
+			"lazy": %q,
+			"eager": {
+				"path": %q,
+				"clean": true
+			}
+		}
+	}`, missingPath, missingPath)
+
+	var cfg config
+	cfg.Builders = packer.MapOfBuilder{}
+
+	if err := decodeConfig(strings.NewReader(packerConfigData), &cfg); err != nil {
+		t.Fatalf("error encountered decoding configuration: %v", err)
+	}
+
+	cfg.LoadExternalComponentsFromConfig()
+
+	if !cfg.Builders.Has("lazy") {
+		t.Errorf("expected entry without clean to be registered even though its binary is missing (validated lazily on first use)")
+	}
+
+	if cfg.Builders.Has("eager") {
+		t.Errorf("expected clean entry with a missing binary to be dropped eagerly, but it's still registered")
+	}
+}
+
+func TestPluginClient_checksumMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "packer-builder-fake")
+	if err != nil {
+		t.Fatalf("failed to create temporary plugin file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	var cfg config
+	if _, err := cfg.pluginClient(PluginConfig{Path: f.Name(), Checksum: "deadbeef"}); err == nil {
+		t.Errorf("expected pluginClient to refuse to start a plugin with a mismatched checksum, got nil error")
+	}
+}
+
+func TestVerifyChecksum_caseInsensitive(t *testing.T) {
+	f, err := ioutil.TempFile("", "packer-builder-fake")
+	if err != nil {
+		t.Fatalf("failed to create temporary plugin file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatalf("failed to write temporary plugin file: %v", err)
+	}
+	f.Close()
+
+	// sha256("hello world")
+	const checksum = "B94D27B9934D3E08A52E52D7DA7DABFAC484EFE37A5380EE9088F7ACE2EFCDE9"
+	if err := verifyChecksum(f.Name(), strings.ToLower(checksum)); err != nil {
+		t.Errorf("expected lowercase checksum to match, got error: %v", err)
+	}
+	if err := verifyChecksum(f.Name(), strings.ToUpper(checksum)); err != nil {
+		t.Errorf("expected uppercase checksum to match, got error: %v", err)
+	}
+}
+
+func TestLoadExternalComponentsFromConfig_pluginDirs(t *testing.T) {
+	dir, cleanUpFunc, err := generateFakePluginDir()
+	if err != nil {
+		t.Fatalf("error encountered while creating fake plugin directory: %v", err)
+	}
+	defer cleanUpFunc()
+
+	packerConfigData := fmt.Sprintf(`
+	{
+		"PluginMinPort": 10,
+		"PluginMaxPort": 25,
+		"plugin_dirs": [%q]
+	}`, dir)
+
+	var cfg config
+	cfg.Builders = packer.MapOfBuilder{}
+	cfg.PostProcessors = packer.MapOfPostProcessor{}
+	cfg.Provisioners = packer.MapOfProvisioner{}
+
+	if err := decodeConfig(strings.NewReader(packerConfigData), &cfg); err != nil {
+		t.Fatalf("error encountered decoding configuration: %v", err)
+	}
+
+	cfg.LoadExternalComponentsFromConfig()
+
+	if len(cfg.Builders) != 1 || !cfg.Builders.Has("cloud-xyz") {
+		t.Errorf("failed to discover builder from plugin_dirs; got %v as the resulting config", cfg.Builders)
+	}
+
+	if len(cfg.Provisioners) != 1 || !cfg.Provisioners.Has("super-shell") {
+		t.Errorf("failed to discover provisioner from plugin_dirs; got %v as the resulting config", cfg.Provisioners)
+	}
+
+	if len(cfg.PostProcessors) != 1 || !cfg.PostProcessors.Has("noop") {
+		t.Errorf("failed to discover post-processor from plugin_dirs; got %v as the resulting config", cfg.PostProcessors)
+	}
+}
+
+func TestLoadExternalComponentsFromConfig_pluginDirsExplicitWins(t *testing.T) {
+	dir, cleanUpFunc, err := generateFakePluginDir()
+	if err != nil {
+		t.Fatalf("error encountered while creating fake plugin directory: %v", err)
+	}
+	defer cleanUpFunc()
+
+	explicitPath := filepath.Join(dir, "explicit-cloud-xyz")
+	if _, err := os.Create(explicitPath); err != nil {
+		t.Fatalf("failed to create explicit plugin file: %v", err)
+	}
+
+	packerConfigData := fmt.Sprintf(`
+	{
+		"PluginMinPort": 10,
+		"PluginMaxPort": 25,
+		"plugin_dirs": [%q],
+		"builders": {
+			"cloud-xyz": %q
+		}
+	}`, dir, explicitPath)
+
+	var cfg config
+	cfg.Builders = packer.MapOfBuilder{}
+
+	if err := decodeConfig(strings.NewReader(packerConfigData), &cfg); err != nil {
+		t.Fatalf("error encountered decoding configuration: %v", err)
+	}
+
+	cfg.LoadExternalComponentsFromConfig()
+
+	if len(cfg.Builders) != 1 || !cfg.Builders.Has("cloud-xyz") {
+		t.Fatalf("expected exactly one cloud-xyz builder; got %v", cfg.Builders)
+	}
+
+	if cfg.resolvedBuilders["cloud-xyz"].path != explicitPath {
+		t.Errorf("explicit builders entry should win over plugin_dirs discovery; got path %q", cfg.resolvedBuilders["cloud-xyz"].path)
+	}
+}
+
+func TestCleanExternalComponents(t *testing.T) {
+	packerConfigData, cleanUpFunc, err := generateFakePackerConfigData()
+	if err != nil {
+		t.Fatalf("error encountered while creating fake Packer configuration data %v", err)
+	}
+	defer cleanUpFunc()
+
+	var cfg config
+	cfg.Builders = packer.MapOfBuilder{}
+	cfg.PostProcessors = packer.MapOfPostProcessor{}
+	cfg.Provisioners = packer.MapOfProvisioner{}
+
+	if err := decodeConfig(strings.NewReader(packerConfigData), &cfg); err != nil {
+		t.Fatalf("error encountered decoding configuration: %v", err)
+	}
+
+	cfg.LoadExternalComponentsFromConfig()
+
+	builderPath := cfg.resolvedBuilders["cloud-xyz"].path
+	if err := os.Remove(builderPath); err != nil {
+		t.Fatalf("failed to remove builder binary %q: %v", builderPath, err)
+	}
+
+	if err := cfg.CleanExternalComponents(); err != nil {
+		t.Fatalf("error encountered cleaning external components: %v", err)
+	}
+
+	if cfg.Builders.Has("cloud-xyz") {
+		t.Errorf("expected dangling builder cloud-xyz to be removed, but it's still registered")
+	}
+
+	if !cfg.Provisioners.Has("super-shell") {
+		t.Errorf("expected live provisioner super-shell to remain registered")
+	}
+
+	if !cfg.PostProcessors.Has("noop") {
+		t.Errorf("expected live post-processor noop to remain registered")
+	}
+}
+
+func TestLoadExternalComponentsFromConfig_topLevelCleanReload(t *testing.T) {
+	packerConfigData, cleanUpFunc, err := generateFakePackerConfigData()
+	if err != nil {
+		t.Fatalf("error encountered while creating fake Packer configuration data %v", err)
+	}
+	defer cleanUpFunc()
+
+	var cfg config
+	cfg.Builders = packer.MapOfBuilder{}
+	cfg.PostProcessors = packer.MapOfPostProcessor{}
+	cfg.Provisioners = packer.MapOfProvisioner{}
+
+	if err := decodeConfig(strings.NewReader(packerConfigData), &cfg); err != nil {
+		t.Fatalf("error encountered decoding configuration: %v", err)
+	}
+
+	cfg.LoadExternalComponentsFromConfig()
+
+	builderPath := cfg.resolvedBuilders["cloud-xyz"].path
+	if err := os.Remove(builderPath); err != nil {
+		t.Fatalf("failed to remove builder binary %q: %v", builderPath, err)
+	}
+
+	// Reload the exact same config (the "builders" entry for cloud-xyz is
+	// unchanged) with the top-level clean flag set. The dangling builder
+	// must not be re-registered just because its RawBuilders entry is
+	// still present.
+	cfg.Clean = true
+	cfg.LoadExternalComponentsFromConfig()
+
+	if cfg.Builders.Has("cloud-xyz") {
+		t.Errorf("expected top-level clean to drop builder cloud-xyz whose binary went missing, but it's still registered")
+	}
+
+	if !cfg.Provisioners.Has("super-shell") {
+		t.Errorf("expected live provisioner super-shell to remain registered")
+	}
+
+	if !cfg.PostProcessors.Has("noop") {
+		t.Errorf("expected live post-processor noop to remain registered")
+	}
+}
+
+/* generateFakePluginDir creates a directory populated with one mock
+plugin binary for each of the builder, provisioner, and post-processor
+naming conventions. cleanUpFunc removes the directory and should always be
+called by the caller.
+*/
+func generateFakePluginDir() (dir string, cleanUpFunc func(), err error) {
+	dir, err = ioutil.TempDir("", "random-plugindir")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary test directory: %v", err)
+	}
+
+	cleanUpFunc = func() {
+		os.RemoveAll(dir)
+	}
+
+	var suffix string
+	if runtime.GOOS == "windows" {
+		suffix = ".exe"
+	}
+
+	plugins := [...]string{
+		filepath.Join(dir, "packer-builder-cloud-xyz"+suffix),
+		filepath.Join(dir, "packer-provisioner-super-shell"+suffix),
+		filepath.Join(dir, "packer-post-processor-noop"+suffix),
+	}
+	for _, plugin := range plugins {
+		if _, err := os.Create(plugin); err != nil {
+			cleanUpFunc()
+			return "", nil, fmt.Errorf("failed to create temporary plugin file (%s): %v", plugin, err)
+		}
+	}
+
+	return dir, cleanUpFunc, nil
+}
+
 /* generateFakePackerConfigData creates a collection of mock plugins along with a basic packerconfig.
 The return packerConfigData is a valid packerconfig file that can be used for configuring external plugins, cleanUpFunc is a function that should be called for cleaning up any generated mock data.
 This function will only clean up if there is an error, on successful runs the caller
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/packer/plugin"
+)
+
+const (
+	builderPrefix       = "packer-builder-"
+	provisionerPrefix   = "packer-provisioner-"
+	postProcessorPrefix = "packer-post-processor-"
+)
+
+// pluginVersioner is implemented by plugin components that can report
+// their own version. Components that don't implement it are simply not
+// subject to the min_version/max_version checks in PluginConfig.
+type pluginVersioner interface {
+	PackerPluginVersion() string
+}
+
+// pluginClient returns a plugin.Client that manages the external plugin
+// process described by pc. The process isn't started until one of the
+// client's component accessors (Builder, Provisioner, PostProcessor) is
+// called. If pc has a checksum and the binary at pc.Path doesn't match
+// it, pluginClient returns an error instead of a client, so the binary is
+// never exec'd.
+func (c *config) pluginClient(pc PluginConfig) (*plugin.Client, error) {
+	if pc.Checksum != "" {
+		if err := verifyChecksum(pc.Path, pc.Checksum); err != nil {
+			return nil, fmt.Errorf("refusing to start plugin %q: %s", pc.Path, err)
+		}
+	}
+
+	cmd := exec.Command(pc.Path, pc.Args...)
+	if len(pc.Env) > 0 {
+		cmd.Env = append(os.Environ(), pc.Env...)
+	}
+
+	return plugin.NewClient(&plugin.ClientConfig{
+		Cmd:             cmd,
+		HandshakeConfig: plugin.Handshake,
+		MinPort:         c.PluginMinPort,
+		MaxPort:         c.PluginMaxPort,
+	}), nil
+}
+
+// loadPluginDirs scans each directory in c.PluginDirs for binaries named
+// packer-builder-*, packer-provisioner-*, or packer-post-processor-*
+// (with a .exe suffix on Windows) and registers them under the component
+// name taken from the rest of the filename. An explicit entry for the
+// same name in RawBuilders/RawProvisioners/RawPostProcessors always wins
+// over one discovered this way.
+func (c *config) loadPluginDirs() {
+	for _, dir := range c.PluginDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("[ERR] failed to read plugin_dirs entry %q: %s", dir, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			filename := entry.Name()
+			if runtime.GOOS == "windows" {
+				filename = strings.TrimSuffix(filename, ".exe")
+			}
+			path := filepath.Join(dir, entry.Name())
+
+			switch {
+			case strings.HasPrefix(filename, builderPrefix):
+				c.registerDiscoveredBuilder(strings.TrimPrefix(filename, builderPrefix), path)
+			case strings.HasPrefix(filename, provisionerPrefix):
+				c.registerDiscoveredProvisioner(strings.TrimPrefix(filename, provisionerPrefix), path)
+			case strings.HasPrefix(filename, postProcessorPrefix):
+				c.registerDiscoveredPostProcessor(strings.TrimPrefix(filename, postProcessorPrefix), path)
+			}
+		}
+	}
+}
+
+// registerDiscoveredBuilder registers the builder found at path under
+// name, unless an explicit "builders" entry already claims that name.
+func (c *config) registerDiscoveredBuilder(name, path string) {
+	if c.Builders == nil {
+		return
+	}
+	if _, explicit := c.RawBuilders[name]; explicit {
+		return
+	}
+
+	pc := PluginConfig{Path: path}
+	if c.resolvedBuilders == nil {
+		c.resolvedBuilders = make(map[string]resolvedPlugin)
+	}
+	c.resolvedBuilders[name] = resolvedPlugin{path: pc.Path}
+	c.Builders.Set(name, func() (packer.Builder, error) {
+		client, err := c.pluginClient(pc)
+		if err != nil {
+			return nil, err
+		}
+		return client.Builder()
+	})
+}
+
+// registerDiscoveredProvisioner registers the provisioner found at path
+// under name, unless an explicit "provisioners" entry already claims that
+// name.
+func (c *config) registerDiscoveredProvisioner(name, path string) {
+	if c.Provisioners == nil {
+		return
+	}
+	if _, explicit := c.RawProvisioners[name]; explicit {
+		return
+	}
+
+	pc := PluginConfig{Path: path}
+	if c.resolvedProvisioners == nil {
+		c.resolvedProvisioners = make(map[string]resolvedPlugin)
+	}
+	c.resolvedProvisioners[name] = resolvedPlugin{path: pc.Path}
+	c.Provisioners.Set(name, func() (packer.Provisioner, error) {
+		client, err := c.pluginClient(pc)
+		if err != nil {
+			return nil, err
+		}
+		return client.Provisioner()
+	})
+}
+
+// registerDiscoveredPostProcessor registers the post-processor found at
+// path under name, unless an explicit "post-processors" entry already
+// claims that name.
+func (c *config) registerDiscoveredPostProcessor(name, path string) {
+	if c.PostProcessors == nil {
+		return
+	}
+	if _, explicit := c.RawPostProcessors[name]; explicit {
+		return
+	}
+
+	pc := PluginConfig{Path: path}
+	if c.resolvedPostProcessors == nil {
+		c.resolvedPostProcessors = make(map[string]resolvedPlugin)
+	}
+	c.resolvedPostProcessors[name] = resolvedPlugin{path: pc.Path}
+	c.PostProcessors.Set(name, func() (packer.PostProcessor, error) {
+		client, err := c.pluginClient(pc)
+		if err != nil {
+			return nil, err
+		}
+		return client.PostProcessor()
+	})
+}
+
+// pluginIsStale reports whether the plugin described by rp should be
+// considered stale: either its binary is gone, or it has a recorded
+// checksum that the binary no longer matches.
+func pluginIsStale(rp resolvedPlugin) (bool, error) {
+	_, err := os.Stat(rp.path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if rp.checksum == "" {
+		return false, nil
+	}
+
+	if err := verifyChecksum(rp.path, rp.checksum); err != nil {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// verifyChecksum returns an error if the sha256 checksum of the file at
+// path doesn't match the expected, hex-encoded checksum.
+func verifyChecksum(path string, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", path, expected, actual)
+	}
+
+	return nil
+}
+
+// enforcePluginVersion checks component against the min_version/
+// max_version constraints in pc, if any are set and component reports a
+// version via pluginVersioner.
+func enforcePluginVersion(component interface{}, pc PluginConfig) error {
+	if pc.MinVersion == "" && pc.MaxVersion == "" {
+		return nil
+	}
+
+	v, ok := component.(pluginVersioner)
+	if !ok {
+		return nil
+	}
+
+	return checkPluginVersion(v.PackerPluginVersion(), pc.MinVersion, pc.MaxVersion)
+}
+
+// checkPluginVersion returns an error if reported doesn't satisfy the
+// given min/max bounds. Either bound may be empty to leave it
+// unconstrained.
+func checkPluginVersion(reported, min, max string) error {
+	v, err := version.NewVersion(reported)
+	if err != nil {
+		return fmt.Errorf("invalid plugin version %q: %s", reported, err)
+	}
+
+	if min != "" {
+		minV, err := version.NewVersion(min)
+		if err != nil {
+			return fmt.Errorf("invalid min_version %q: %s", min, err)
+		}
+		if v.LessThan(minV) {
+			return fmt.Errorf("plugin version %s is older than the required min_version %s", v, minV)
+		}
+	}
+
+	if max != "" {
+		maxV, err := version.NewVersion(max)
+		if err != nil {
+			return fmt.Errorf("invalid max_version %q: %s", max, err)
+		}
+		if v.GreaterThan(maxV) {
+			return fmt.Errorf("plugin version %s is newer than the allowed max_version %s", v, maxV)
+		}
+	}
+
+	return nil
+}